@@ -0,0 +1,49 @@
+package wk9
+
+import (
+	"sync"
+)
+
+// ReassemblyBudget bounds the bytes held by fragmented messages being
+// reassembled, across all the Conns sharing it.
+type ReassemblyBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	avail int64
+	total int64
+	block bool
+}
+
+// NewReassemblyBudget returns a budget of total bytes. When it is exhausted
+// ReadMessage waits for other messages to complete if block is set, else it
+// fails with ErrReassemblyBudget. A blocking budget can deadlock when every
+// Conn sharing it waits on a partly reassembled message, so size it well
+// above the number of Conns times their typical message.
+func NewReassemblyBudget(total int64, block bool) *ReassemblyBudget {
+	b := &ReassemblyBudget{avail: total, total: total, block: block}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *ReassemblyBudget) acquire(n int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.total {
+		return ErrReassemblyBudget
+	}
+	for b.avail < n {
+		if !b.block {
+			return ErrReassemblyBudget
+		}
+		b.cond.Wait()
+	}
+	b.avail -= n
+	return nil
+}
+
+func (b *ReassemblyBudget) release(n int64) {
+	b.mu.Lock()
+	b.avail += n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
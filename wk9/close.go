@@ -0,0 +1,166 @@
+package wk9
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Close codes defined in Section 7.4.1 of RFC 6455.
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+	CloseServiceRestart          = 1012
+	CloseTryAgainLater           = 1013
+	CloseBadGateway              = 1014
+	CloseTLSHandshake            = 1015
+)
+
+// CloseCategory returns the category of a close code for logs and metrics
+// labels: "normal", "client-error" for data the endpoint refused, "protocol",
+// "server-error" for an endpoint unable to go on, "application" for the
+// registered and application codes 3000-4999, whose meaning is up to the
+// endpoints, or "abnormal" for the codes never sent in a close frame and any
+// other code.
+func CloseCategory(code int) string {
+	if code >= 3000 && code <= 4999 {
+		return "application"
+	}
+	switch code {
+	case CloseNormalClosure, CloseGoingAway:
+		return "normal"
+	case CloseUnsupportedData, ClosePolicyViolation, CloseMessageTooBig:
+		return "client-error"
+	case CloseProtocolError, CloseInvalidFramePayloadData, CloseMandatoryExtension:
+		return "protocol"
+	case CloseInternalServerErr, CloseServiceRestart, CloseTryAgainLater, CloseBadGateway:
+		return "server-error"
+	}
+	return "abnormal"
+}
+
+// CloseError is returned by ReadMessage when the peer closes the connection.
+// It matches ErrMessageClose with errors.Is.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("close control message, code=%d, text=%s", e.Code, e.Text)
+}
+
+// Is reports whether target is ErrMessageClose.
+func (e *CloseError) Is(target error) bool {
+	return target == ErrMessageClose
+}
+
+// incompleteError is the error of a read interrupted by the peer's close
+// before the final frame of the message. errors.Is matches it with
+// ErrMessageIncomplete and errors.As still finds the *CloseError.
+type incompleteError struct {
+	err error
+}
+
+func (e *incompleteError) Error() string {
+	return "message incomplete: " + e.err.Error()
+}
+
+// Unwrap returns the *CloseError.
+func (e *incompleteError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is ErrMessageIncomplete.
+func (e *incompleteError) Is(target error) bool {
+	return target == ErrMessageIncomplete
+}
+
+// incomplete returns err as an incompleteError if it is a close, for a read
+// in the middle of a message.
+func incomplete(err error) error {
+	if _, ok := err.(*CloseError); ok {
+		return &incompleteError{err: err}
+	}
+	return err
+}
+
+// ProtocolError is returned when the peer breaks the protocol, Code is the
+// close code the violation calls for. It unwraps to the detailed error, so
+// errors.Is matches sentinels like ErrReadLimit.
+type ProtocolError struct {
+	Code int
+	Err  error
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the detailed error.
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// protocolError returns a ProtocolError calling for close code code.
+func protocolError(code int, err error) error {
+	return &ProtocolError{Code: code, Err: err}
+}
+
+// FormatCloseMessage formats a close message payload, CloseNoStatusReceived
+// gives an empty payload.
+func FormatCloseMessage(code int, text string) []byte {
+	if code == CloseNoStatusReceived {
+		return []byte{}
+	}
+	b := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(b, uint16(code))
+	copy(b[2:], text)
+	return b
+}
+
+// validCloseCode reports whether code may be sent in a close frame: the
+// codes defined by the RFC and IANA, and 3000-4999 for libraries and
+// applications.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// parseClose parses a close frame payload, an empty one is
+// CloseNoStatusReceived.
+func parseClose(payload []byte) (code int, text string, err error) {
+	if len(payload) == 0 {
+		return CloseNoStatusReceived, "", nil
+	}
+	if len(payload) < 2 {
+		return 0, "", fmt.Errorf("invalid close payload length %d", len(payload))
+	}
+	if code = int(binary.BigEndian.Uint16(payload)); !validCloseCode(code) {
+		return 0, "", fmt.Errorf("invalid close code %d", code)
+	}
+	return code, string(payload[2:]), nil
+}
+
+// closeReadError is the error a read returns for a close frame payload, a
+// *CloseError or a ProtocolError if the payload is invalid.
+func closeReadError(payload []byte) error {
+	code, text, err := parseClose(payload)
+	if err != nil {
+		return protocolError(CloseProtocolError, err)
+	}
+	return &CloseError{Code: code, Text: text}
+}
@@ -0,0 +1,201 @@
+package wk9
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// FrameHeader is a frame header as laid out in Section 5.2 of RFC 6455.
+type FrameHeader struct {
+	Fin              bool
+	Rsv1, Rsv2, Rsv3 bool
+	Op               int
+	Masked           bool
+	Length           int64
+	MaskKey          [4]byte
+}
+
+// DecodeHeader read a frame header from r.
+func DecodeHeader(r io.Reader) (FrameHeader, error) {
+	var b [8]byte
+	return decodeHeader(r, b[:], false)
+}
+
+// decodeHeader read a frame header from r through b, a scratch buffer of 8
+// bytes, with minimal set a length not using the shortest encoding is
+// rejected.
+func decodeHeader(r io.Reader, b []byte, minimal bool) (h FrameHeader, err error) {
+	// 1.First byte. FIN/RSV1/RSV2/RSV3/OpCode(4bits)
+	// 2.Second byte. Mask/Payload len(7bits)
+	if _, err = io.ReadFull(r, b[:2]); err != nil {
+		return
+	}
+	h.Fin = b[0]&finBit != 0
+	h.Rsv1 = b[0]&rsv1Bit != 0
+	h.Rsv2 = b[0]&rsv2Bit != 0
+	h.Rsv3 = b[0]&rsv3Bit != 0
+	h.Op = int(b[0] & opCode)
+	h.Masked = b[1]&maskBit != 0
+	// payload length
+	switch b[1] & lenBit {
+	case 126:
+		// 16 bits
+		if _, err = io.ReadFull(r, b[:2]); err != nil {
+			return
+		}
+		h.Length = int64(binary.BigEndian.Uint16(b[:2]))
+		if minimal && h.Length < 126 {
+			err = protocolError(CloseProtocolError, fmt.Errorf("non-minimal 16 bits payload length %d", h.Length))
+			return
+		}
+	case 127:
+		// 64 bits
+		if _, err = io.ReadFull(r, b[:8]); err != nil {
+			return
+		}
+		// the most significant bit MUST be 0
+		if h.Length = int64(binary.BigEndian.Uint64(b[:8])); h.Length < 0 {
+			err = protocolError(CloseMessageTooBig, ErrFrameTooLarge)
+			return
+		}
+		if minimal && h.Length < 65536 {
+			err = protocolError(CloseProtocolError, fmt.Errorf("non-minimal 64 bits payload length %d", h.Length))
+			return
+		}
+	default:
+		// 7 bits
+		h.Length = int64(b[1] & lenBit)
+	}
+	// mask key
+	if h.Masked {
+		if _, err = io.ReadFull(r, b[:4]); err == nil {
+			copy(h.MaskKey[:], b[:4])
+		}
+	}
+	return
+}
+
+// EncodeHeader write a frame header to w using the shortest length encoding.
+func EncodeHeader(w io.Writer, h FrameHeader) error {
+	var (
+		b [14]byte
+		n = 2
+	)
+	// 1.First byte. FIN/RSV1/RSV2/RSV3/OpCode(4bits)
+	b[0] = byte(h.Op) & opCode
+	if h.Fin {
+		b[0] |= finBit
+	}
+	if h.Rsv1 {
+		b[0] |= rsv1Bit
+	}
+	if h.Rsv2 {
+		b[0] |= rsv2Bit
+	}
+	if h.Rsv3 {
+		b[0] |= rsv3Bit
+	}
+	// 2.Second byte. Mask/Payload len(7bits)
+	switch {
+	case h.Length <= 125:
+		// 7 bits
+		b[1] = byte(h.Length)
+	case h.Length < 65536:
+		// 16 bits
+		b[1] = 126
+		binary.BigEndian.PutUint16(b[2:], uint16(h.Length))
+		n += 2
+	default:
+		// 64 bits
+		b[1] = 127
+		binary.BigEndian.PutUint64(b[2:], uint64(h.Length))
+		n += 8
+	}
+	if h.Masked {
+		b[1] |= maskBit
+		n += copy(b[n:], h.MaskKey[:])
+	}
+	_, err := w.Write(b[:n])
+	return err
+}
+
+// ReadFrameFrom reads a whole frame from r, e.g. a capture, without a Conn.
+// The payload is returned unmasked, h still tells whether it was masked. It
+// is read DefaultReadChunkSize bytes at a time so a bogus length fails on the
+// missing data rather than allocating it upfront.
+func ReadFrameFrom(r io.Reader) (h FrameHeader, payload []byte, err error) {
+	if h, err = DecodeHeader(r); err != nil {
+		return
+	}
+	if h.Length > maxInt {
+		return h, nil, protocolError(CloseMessageTooBig, ErrFrameTooLarge)
+	}
+	for n := h.Length; n > 0; {
+		chunk := n
+		if chunk > DefaultReadChunkSize {
+			chunk = DefaultReadChunkSize
+		}
+		off := len(payload)
+		payload = append(payload, make([]byte, chunk)...)
+		if _, err = io.ReadFull(r, payload[off:]); err != nil {
+			return h, nil, err
+		}
+		n -= chunk
+	}
+	if h.Masked {
+		maskBytes(h.MaskKey[:], 0, payload)
+	}
+	return
+}
+
+// WriteFrameTo writes h and payload as a frame to w, the header length is
+// taken from payload. With h.Masked the payload is masked with h.MaskKey
+// through a small buffer, payload itself is left untouched.
+func WriteFrameTo(w io.Writer, h FrameHeader, payload []byte) (err error) {
+	h.Length = int64(len(payload))
+	if err = EncodeHeader(w, h); err != nil {
+		return
+	}
+	if !h.Masked {
+		if len(payload) > 0 {
+			_, err = w.Write(payload)
+		}
+		return
+	}
+	var (
+		b   [512]byte
+		pos int
+	)
+	for len(payload) > 0 {
+		n := copy(b[:], payload)
+		pos = maskBytes(h.MaskKey[:], pos, b[:n])
+		if _, err = w.Write(b[:n]); err != nil {
+			return
+		}
+		payload = payload[n:]
+	}
+	return
+}
+
+// ParseFrames decodes data as frames one after the other until it is used
+// up, e.g. the bytes a Conn wrote, returning their headers and unmasked
+// payloads. A frame cut short fails with io.ErrUnexpectedEOF.
+func ParseFrames(data []byte) (hs []FrameHeader, payloads [][]byte, err error) {
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		var (
+			h FrameHeader
+			p []byte
+		)
+		if h, p, err = ReadFrameFrom(r); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		hs, payloads = append(hs, h), append(payloads, p)
+	}
+	return
+}
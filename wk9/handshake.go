@@ -0,0 +1,57 @@
+package wk9
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// acceptGUID is the GUID from Section 1.3 of RFC 6455.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ComputeAcceptKey returns the Sec-WebSocket-Accept value for the given
+// Sec-WebSocket-Key.
+func ComputeAcceptKey(secWebSocketKey string) string {
+	h := sha1.New()
+	h.Write([]byte(secWebSocketKey))
+	h.Write([]byte(acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// GenerateKey returns a Sec-WebSocket-Key made of 16 bytes read from r, or
+// from crypto/rand if r is nil.
+func GenerateKey(r io.Reader) (string, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+	var b [16]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b[:]), nil
+}
+
+// IsWebSocketUpgrade reports whether r asks for a WebSocket upgrade, its
+// Connection header holding the upgrade token and its Upgrade header the
+// websocket one, case-insensitively. Only headers are looked at, the body is
+// left alone.
+func IsWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") &&
+		headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// headerHasToken reports whether the comma separated values of header name
+// hold token, case-insensitively.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
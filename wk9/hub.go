@@ -0,0 +1,129 @@
+package wk9
+
+import (
+	"sync"
+)
+
+const (
+	// CloseOnFull evicts and closes a connection whose queue is full, it's
+	// the default.
+	CloseOnFull = 0
+	// DropOldest drops the oldest queued message to make room.
+	DropOldest = 1
+	// DropNewest drops the message being broadcast for that connection.
+	DropNewest = 2
+)
+
+// Hub broadcasts messages to the registered connections. Each connection
+// has its own bounded send queue drained by a goroutine, so a slow
+// connection never stalls the others, what happens when its queue is full is
+// set by SetDropPolicy.
+type Hub struct {
+	mu        sync.Mutex
+	conns     map[*Conn]chan *PreparedMessage
+	queueSize int
+	policy    int
+}
+
+// NewHub returns a Hub whose send queues hold up to queueSize messages. With
+// zero a message only goes to a connection whose write loop is idle, and
+// DropOldest then behaves like DropNewest.
+func NewHub(queueSize int) *Hub {
+	return &Hub{conns: make(map[*Conn]chan *PreparedMessage), queueSize: queueSize}
+}
+
+// SetDropPolicy sets what Broadcast does for a connection whose queue is
+// full, CloseOnFull, DropOldest or DropNewest.
+func (h *Hub) SetDropPolicy(policy int) {
+	h.mu.Lock()
+	h.policy = policy
+	h.mu.Unlock()
+}
+
+// Register adds c to the hub.
+func (h *Hub) Register(c *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.conns[c]; ok {
+		return
+	}
+	q := make(chan *PreparedMessage, h.queueSize)
+	h.conns[c] = q
+	go h.writeLoop(c, q)
+}
+
+// Unregister removes c from the hub, c is left open.
+func (h *Hub) Unregister(c *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(c)
+}
+
+// Len returns the number of registered connections.
+func (h *Hub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.conns)
+}
+
+// Broadcast queues data as a binary message to every registered connection.
+func (h *Hub) Broadcast(data []byte) error {
+	pm, err := NewPreparedMessage(BinaryFrame, data)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c, q := range h.conns {
+		select {
+		case q <- pm:
+			continue
+		default:
+		}
+		// slow client
+		switch h.policy {
+		case DropOldest:
+			// only Broadcast sends, under mu, so a drained slot is kept,
+			// an unbuffered queue has none and drops pm like DropNewest
+			select {
+			case <-q:
+			default:
+			}
+			select {
+			case q <- pm:
+			default:
+			}
+		case DropNewest:
+		default:
+			h.evict(c)
+		}
+	}
+	return nil
+}
+
+func (h *Hub) writeLoop(c *Conn, q chan *PreparedMessage) {
+	for pm := range q {
+		if err := c.WritePreparedMessage(pm); err != nil {
+			h.mu.Lock()
+			if h.conns[c] == q {
+				h.evict(c)
+			}
+			h.mu.Unlock()
+			return
+		}
+	}
+}
+
+// remove stops the send queue of c, caller must hold mu.
+func (h *Hub) remove(c *Conn) {
+	if q, ok := h.conns[c]; ok {
+		delete(h.conns, c)
+		close(q)
+	}
+}
+
+// evict removes and closes c, caller must hold mu.
+func (h *Hub) evict(c *Conn) {
+	h.remove(c)
+	c.Close()
+}
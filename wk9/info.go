@@ -0,0 +1,32 @@
+package wk9
+
+// ConnInfo describes how a Conn is set up, see Conn.Info.
+type ConnInfo struct {
+	// Client is set for a client side Conn.
+	Client bool
+	// ReadLimit, ReadChunkSize, ReadSizeHint and MaxFrameSize are the read
+	// settings, zero when unset.
+	ReadLimit     int64
+	ReadChunkSize int
+	ReadSizeHint  int
+	MaxFrameSize  int64
+	// WriteBufferSize is the size of the write buffer.
+	WriteBufferSize int
+}
+
+// Info returns the role and the buffer settings of the Conn. There is no
+// handshake in a Conn, so the subprotocol and extensions are up to the
+// caller.
+func (c *Conn) Info() ConnInfo {
+	c.wmu.Lock()
+	wsize := c.wtr.Available() + c.wtr.Buffered()
+	c.wmu.Unlock()
+	return ConnInfo{
+		Client:          c.client,
+		ReadLimit:       c.readLimit,
+		ReadChunkSize:   c.readChunk,
+		ReadSizeHint:    c.sizeHint,
+		MaxFrameSize:    c.maxFrameSize,
+		WriteBufferSize: wsize,
+	}
+}
@@ -0,0 +1,39 @@
+package wk9
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SetJSONMessageType sets the message type WriteJSON sends and ReadJSONStream
+// expects, TextFrame by default, BinaryFrame for protocols that carry JSON
+// in binary messages.
+func (c *Conn) SetJSONMessageType(op int) {
+	c.jsonOp = op
+}
+
+// WriteJSON writes the JSON encoding of v as a message of the JSON message
+// type.
+func (c *Conn) WriteJSON(v interface{}) error {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(c.jsonOp, p)
+}
+
+// ReadJSONStream decodes the next message into v as it is read through
+// NextReader, so a large message is never held whole. A message of another
+// type than the JSON one fails with ErrJSONMessageType, a close with the
+// *CloseError. Whatever v leaves of the message is discarded by the next
+// read.
+func (c *Conn) ReadJSONStream(v interface{}) error {
+	op, r, err := c.NextReader()
+	if err != nil {
+		return err
+	}
+	if op != c.jsonOp {
+		return fmt.Errorf("%w, op=%d", ErrJSONMessageType, op)
+	}
+	return json.NewDecoder(r).Decode(v)
+}
@@ -1,10 +1,16 @@
 package wk9
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Terry-Mao/goim/pkg/bufio"
 )
@@ -23,6 +29,23 @@ const (
 
 	continuationFrame        = 0
 	continuationFrameMaxRead = 100
+	maxControlPayload        = 125
+	maxInt                   = int64(^uint(0) >> 1)
+	// pongWriteWait bounds the automatic pong write.
+	pongWriteWait = time.Second
+	// closeWriteWait bounds the close frame write of CloseBestEffort.
+	closeWriteWait = time.Second
+	// maxRetainedRead caps the message buffer kept between reads.
+	maxRetainedRead = 1 << 20
+
+	// StrictMode treats every protocol violation as fatal, it's the default.
+	StrictMode = 0
+	// LenientMode logs the violations listed on SetProtocolMode and keeps
+	// reading the frame.
+	LenientMode = 1
+
+	// DefaultReadChunkSize is a sensible chunk size for SetReadChunkSize.
+	DefaultReadChunkSize = 64 * 1024
 )
 
 // The frame types are defined in RFC 6455, section 11.8.
@@ -58,145 +81,1386 @@ var (
 	ErrMessageClose = errors.New("close control message")
 	// ErrMessageMaxRead continuation frame max read
 	ErrMessageMaxRead = errors.New("continuation frame max read")
+	// ErrEmptyFragments message has too many empty continuation frames
+	ErrEmptyFragments = errors.New("too many empty continuation frames")
+	// ErrJSONMessageType JSON read from a message of another type
+	ErrJSONMessageType = errors.New("not a JSON message type")
+	// ErrControlFlood too many control frames within the window
+	ErrControlFlood = errors.New("too many control frames")
+	// ErrNotTCP underlying connection isn't a TCP one
+	ErrNotTCP = errors.New("not a tcp connection")
+	// ErrFrameTooLarge frame payload length over the limit
+	ErrFrameTooLarge = errors.New("frame too large")
+	// ErrReassemblyBudget reassembly budget exhausted
+	ErrReassemblyBudget = errors.New("reassembly budget exhausted")
+	// ErrInvalidUTF8 text message is not valid UTF-8
+	ErrInvalidUTF8 = errors.New("invalid UTF-8 in text message")
+	// ErrMessageOpen a message is still being read or written
+	ErrMessageOpen = errors.New("message still open")
+	// ErrReadLimit message exceeds the read limit
+	ErrReadLimit = errors.New("read limit exceeded")
+	// ErrConnClosing connection is closing
+	ErrConnClosing = errors.New("connection is closing")
+	// ErrConnClosed connection closed by Close
+	ErrConnClosed = errors.New("use of closed connection")
+	// ErrControlTooLarge control message payload over 125 bytes
+	ErrControlTooLarge = errors.New("control message payload too large")
+	// ErrWriterOpen a NextWriter message is not closed yet
+	ErrWriterOpen = errors.New("message writer is open")
+	// ErrWriterClosed write to a closed message writer
+	ErrWriterClosed = errors.New("message writer is closed")
+	// ErrMessageIncomplete message aborted before its final frame
+	ErrMessageIncomplete = errors.New("message incomplete")
 )
 
 // Conn represents a WebSocket connection.
 type Conn struct {
-	rwc     io.ReadWriteCloser
-	rdr     *bufio.Reader
+	// reallocs counts the message buffer growths, see Stats. It comes first
+	// to be 64-bit aligned for atomic access on 32-bit platforms.
+	reallocs int64
+	// readFrames and writeFrames count the frames by opcode, see Stats.
+	readFrames  [16]int64
+	writeFrames [16]int64
+
+	rwc io.ReadWriteCloser
+	// rdr batches the underlying reads, frame headers and payloads are
+	// served from its buffer, so a burst of small frames is parsed from a
+	// single read.
+	rdr     reader
 	wtr     *bufio.Writer
 	maskKey []byte
+	// hdr is the scratch buffer frame headers are decoded through.
+	hdr [8]byte
+	// client is set for the client side, which masks its frames with keys
+	// read from maskRand.
+	client   bool
+	maskRand io.Reader
+	// readChunk caps a single payload read, 0 reads the payload at once.
+	readChunk int
+	// readLimit caps the size of a reassembled message, 0 is unlimited.
+	// textLimit and binaryLimit replace it for their type when set.
+	readLimit   int64
+	textLimit   int64
+	binaryLimit int64
+	// softLimitHandler is called once a message grows past softLimit.
+	softLimit        int64
+	softLimitHandler func(size int64)
+	// idleTimeout pushes the read deadline on each frame.
+	idleTimeout time.Duration
+	// frameTimeout bounds the read of a single frame's payload.
+	frameTimeout time.Duration
+	// rlimit and wlimit throttle reads and writes when set.
+	rlimit, wlimit *rateLimiter
+	// readDeadline and writeDeadline as last set by the caller.
+	readDeadline, writeDeadline time.Time
+	// sizeHint is the expected message size for preallocation.
+	sizeHint int
+	// maxFrameSize caps a frame's payload length, 0 is unlimited.
+	maxFrameSize int64
+	// maxFragments caps the frames of a message, 0 is the default, and
+	// maxEmpty the empty ones, 0 is unlimited.
+	maxFragments int
+	maxEmpty     int
+	// ctrlLimit caps the control frames read per ctrlWindow, 0 is
+	// unlimited. ctrlCount counts them since ctrlStart.
+	ctrlLimit  int
+	ctrlWindow time.Duration
+	ctrlStart  time.Time
+	ctrlCount  int
+	// minimalLength rejects non-minimal length encodings.
+	minimalLength bool
+	// returnControl makes ReadMessage return control frames.
+	returnControl bool
+	// copyPayload makes ReadMessage return a copy of the retained buffer.
+	copyPayload bool
+	// jsonOp is the message type of JSON messages.
+	jsonOp int
+	// closeErr is the close read from the peer, or the error a read closed
+	// the connection for, returned by every later read instead of parsing
+	// what follows it.
+	closeErr error
+	// rerr is a read error that left a frame partly read, e.g. a payload
+	// read timing out, returned by every later read.
+	rerr error
+	// msgOp and msg hold the message being reassembled, msgFrames counts
+	// its continuation frames.
+	msgOp     int
+	msg       []byte
+	msgFrames fragmentCount
+	// rbuf is the message buffer retained across ReadMessage calls.
+	rbuf []byte
+	// reader is the last NextReader, validateUTF8 checks its text.
+	reader       *messageReader
+	validateUTF8 bool
+	// budget, when set, accounts msgReserved bytes of msg.
+	budget      *ReassemblyBudget
+	msgReserved int64
+	// pongHandler is called for pongs, after the RTT bookkeeping.
+	pongHandler func(appData string) error
+	rttMu       sync.Mutex
+	rtt         rttStats
+	// mode is StrictMode or LenientMode.
+	mode int
+	// paused blocks reads until cleared, see PauseReads.
+	pauseMu   sync.Mutex
+	pauseCond *sync.Cond
+	paused    bool
+
+	// wmu serializes frame writes, a close observed by the reader waits
+	// for the in-progress frame before it is echoed.
+	wmu     sync.Mutex
+	closing bool
+	// writing is set while a NextWriter message is open.
+	writing bool
+	// copyBuf is reused by the open message writer's ReadFrom.
+	copyBuf []byte
+	// closed is set by Close.
+	closed int32
+	// manualFlush leaves data frames buffered until Flush.
+	manualFlush bool
+	// maxWriteFrame splits written data messages in frames, 0 doesn't.
+	maxWriteFrame int
+	// coalesceDelay and coalesceSize set by SetWriteCoalescing, flushTimer
+	// is armed while coalesced frames are pending.
+	coalesceDelay time.Duration
+	coalesceSize  int
+	flushTimer    *time.Timer
+	// werr is the first write error, a failed write may leave a half
+	// written frame on the wire so the connection can't be written again.
+	werr error
 }
 
 // new connection
-func newConn(rwc io.ReadWriteCloser, r *bufio.Reader, w *bufio.Writer) *Conn {
-	return &Conn{rwc: rwc, rdr: r, wtr: w, maskKey: make([]byte, 4)}
+func newConn(rwc io.ReadWriteCloser, r reader, w *bufio.Writer) *Conn {
+	c := &Conn{rwc: rwc, rdr: r, wtr: w, maskKey: make([]byte, 4), maskRand: rand.Reader, copyPayload: true, jsonOp: TextFrame}
+	c.pauseCond = sync.NewCond(&c.pauseMu)
+	return c
+}
+
+// NewConn returns a Conn over rwc, e.g. one end of a net.Pipe. A client Conn
+// masks the frames it writes as required by Section 5.3 of RFC 6455, and
+// fails with a ProtocolError on a masked frame from the server.
+// Payloads are read with DefaultReadChunkSize so frames larger than the read
+// buffer can be read.
+func NewConn(rwc io.ReadWriteCloser, client bool) *Conn {
+	c := newConn(rwc, bufio.NewReader(rwc), bufio.NewWriter(rwc))
+	c.client = client
+	c.readChunk = DefaultReadChunkSize
+	return c
+}
+
+// NewServerConn returns a server side Conn over a raw connection whose
+// handshake was done out of band.
+func NewServerConn(rwc io.ReadWriteCloser) *Conn {
+	return NewConn(rwc, false)
+}
+
+// NewClientConn returns a client side Conn over a raw connection whose
+// handshake was done out of band.
+func NewClientConn(rwc io.ReadWriteCloser) *Conn {
+	return NewConn(rwc, true)
+}
+
+// SetReadChunkSize sets the maximum number of payload bytes read at a time.
+// A frame's payload is then read into a buffer that grows chunk by chunk
+// instead of being taken from the reader at once, so a length header the
+// peer never fills doesn't pin a large allocation. Zero disables it.
+func (c *Conn) SetReadChunkSize(n int) {
+	c.readChunk = n
+}
+
+// SetReadLimit sets the maximum size in bytes of a message read from the
+// peer, text and binary messages alike unless SetTextReadLimit or
+// SetBinaryReadLimit is set for their type. The limit applies to each
+// message on its own, not to the bytes read in total. A frame taking its
+// message past the limit is rejected from its header, before its payload is
+// read. Zero means no limit.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// ReadLimit returns the limit set by SetReadLimit.
+func (c *Conn) ReadLimit() int64 {
+	return c.readLimit
+}
+
+// SetTextReadLimit sets a read limit for text messages only, in place of
+// the SetReadLimit one. Zero falls back to it.
+func (c *Conn) SetTextReadLimit(limit int64) {
+	c.textLimit = limit
+}
+
+// SetBinaryReadLimit is SetTextReadLimit for binary messages.
+func (c *Conn) SetBinaryReadLimit(limit int64) {
+	c.binaryLimit = limit
+}
+
+// limitFor returns the read limit of a message of type op.
+func (c *Conn) limitFor(op int) int64 {
+	if op == TextFrame && c.textLimit > 0 {
+		return c.textLimit
+	}
+	if op == BinaryFrame && c.binaryLimit > 0 {
+		return c.binaryLimit
+	}
+	return c.readLimit
+}
+
+// ReadLimits groups the limits on what the peer sends, zero leaves a limit
+// at its default. They are checked in this order, each failing with its own
+// error:
+//
+//   - MaxFrameSize, the payload length of a frame, ErrFrameTooLarge;
+//   - MaxMessageSize, the size of a message, ErrReadLimit;
+//   - MaxFragments, the frames of a fragmented message beyond the first,
+//     ErrMessageMaxRead, 100 by default;
+//   - MaxEmptyFragments, the empty ones among them, ErrEmptyFragments,
+//     unlimited by default.
+//
+// The sizes are checked from the frame header, before the payload is read.
+type ReadLimits struct {
+	MaxFrameSize      int64
+	MaxMessageSize    int64
+	MaxFragments      int
+	MaxEmptyFragments int
+}
+
+// SetReadLimits sets all the read limits at once, MaxFrameSize and
+// MaxMessageSize are the ones of SetMaxFrameSize and SetReadLimit.
+func (c *Conn) SetReadLimits(l ReadLimits) {
+	c.maxFrameSize, c.readLimit = l.MaxFrameSize, l.MaxMessageSize
+	c.maxFragments, c.maxEmpty = l.MaxFragments, l.MaxEmptyFragments
+}
+
+// fragmentLimit returns the maximum number of frames after the first one in
+// a message.
+func (c *Conn) fragmentLimit() int {
+	if c.maxFragments > 0 {
+		return c.maxFragments
+	}
+	return continuationFrameMaxRead
+}
+
+// fragmentCount counts the continuation frames of a message.
+type fragmentCount struct {
+	frames, empty int
+}
+
+// add counts a continuation frame of n bytes against the limits of c.
+func (f *fragmentCount) add(c *Conn, n int) error {
+	if f.frames++; f.frames > c.fragmentLimit() {
+		return protocolError(ClosePolicyViolation, ErrMessageMaxRead)
+	}
+	if n == 0 && c.maxEmpty > 0 {
+		if f.empty++; f.empty > c.maxEmpty {
+			return protocolError(ClosePolicyViolation, ErrEmptyFragments)
+		}
+	}
+	return nil
+}
+
+// SetReadSoftLimit sets a size in bytes past which h is called once per
+// message with the size read so far, e.g. 80% of the read limit, so a large
+// message can be logged before SetReadLimit rejects it. The message is still
+// read. Zero or a nil h removes it.
+func (c *Conn) SetReadSoftLimit(limit int64, h func(size int64)) {
+	c.softLimit, c.softLimitHandler = limit, h
+}
+
+// crossSoftLimit calls the soft limit handler if a message grew from prev
+// past the soft limit to n bytes.
+func (c *Conn) crossSoftLimit(prev, n int64) {
+	if c.softLimitHandler != nil && c.softLimit > 0 && prev <= c.softLimit && n > c.softLimit {
+		c.softLimitHandler(n)
+	}
+}
+
+// SetReadRateLimit limits reads to rate bytes per second with bursts of up
+// to burst bytes, ReadMessage blocks once the budget is spent. A frame is
+// paid for once its header is read, before its payload. If that would outlast
+// the read deadline the read fails with os.ErrDeadlineExceeded, the frame is
+// left partly read so every later read fails the same. A rate of zero
+// removes the limit.
+func (c *Conn) SetReadRateLimit(rate, burst int) {
+	c.rlimit = nil
+	if rate > 0 {
+		c.rlimit = newRateLimiter(rate, burst)
+	}
+}
+
+// SetWriteRateLimit is SetReadRateLimit for writes against the write
+// deadline.
+func (c *Conn) SetWriteRateLimit(rate, burst int) {
+	c.wlimit = nil
+	if rate > 0 {
+		c.wlimit = newRateLimiter(rate, burst)
+	}
+}
+
+// SetReadDeadline sets the read deadline on the underlying connection if it
+// supports deadlines, a zero value means no deadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.setReadDeadline(t)
+}
+
+// SetFrameTimeout sets how long a frame's payload may take to arrive once
+// its header is read, bounding a peer trickling a large frame. The read
+// deadline still applies if it is earlier. A frame timing out is partly read,
+// so the Conn can't be read from anymore, every later read fails with the
+// same error. Zero means no timeout.
+func (c *Conn) SetFrameTimeout(d time.Duration) {
+	c.frameTimeout = d
+}
+
+// SetControlFrameLimit caps the control frames the peer may send to n per
+// window, above it a close with ClosePolicyViolation is sent, the connection
+// is closed and the read, and every later one, fails with ErrControlFlood. A zero window counts over the whole
+// connection, a zero n is unlimited.
+func (c *Conn) SetControlFrameLimit(n int, window time.Duration) {
+	c.ctrlLimit, c.ctrlWindow = n, window
+	c.ctrlStart, c.ctrlCount = time.Time{}, 0
+}
+
+// SetWriteDeadline sets the write deadline on the underlying connection if
+// it supports deadlines, a zero value means no deadline. It may be called
+// while other goroutines write, the automatic pong included.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	// set first so a write blocked under wmu returns, then again under wmu
+	// so a write restoring the previous deadline can't undo it
+	c.setWriteDeadline(t)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.writeDeadline = t
+	return c.setWriteDeadline(t)
+}
+
+// lastWriteDeadline returns the write deadline set by the caller, writes
+// read it under wmu.
+func (c *Conn) lastWriteDeadline() time.Time {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeDeadline
+}
+
+// SetReassemblyBudget makes fragmented messages take the bytes they
+// accumulate from b, shared with other Conns, until they are returned.
+func (c *Conn) SetReassemblyBudget(b *ReassemblyBudget) {
+	c.budget = b
+}
+
+// SetReadSizeHint sets the expected size of a message. The buffer of a
+// fragmented message is preallocated to it, and chunked reads allocate frames
+// up to it at once instead of growing them chunk by chunk.
+func (c *Conn) SetReadSizeHint(n int) {
+	c.sizeHint = n
+}
+
+// SetMaxFrameSize sets the maximum payload length of a single frame, a frame
+// declaring more fails with ErrFrameTooLarge before its payload is read.
+// Zero only rejects lengths that don't fit an int.
+func (c *Conn) SetMaxFrameSize(n int64) {
+	c.maxFrameSize = n
+}
+
+// SetMinimalLength sets whether frames must use the shortest payload length
+// encoding as Section 5.2 of RFC 6455 requires, i.e. a 16 bits length below
+// 126 or a 64 bits length below 65536 is an error. Off by default.
+func (c *Conn) SetMinimalLength(on bool) {
+	c.minimalLength = on
+}
+
+// SetCopyPayload sets whether ReadMessage returns data payloads copied out of
+// the buffer the Conn reads messages into, so the caller owns them. On by
+// default. Off saves the copy, a payload is then only valid until the next
+// ReadMessage or NextReader call.
+func (c *Conn) SetCopyPayload(on bool) {
+	c.copyPayload = on
+}
+
+// SetReturnControl sets whether ReadMessage returns ping, pong and close
+// frames to the caller instead of handling them. When on, nothing answers
+// pings or echoes closes, that is left to the caller.
+func (c *Conn) SetReturnControl(on bool) {
+	c.returnControl = on
+}
+
+// SetMaxWriteFrameSize makes WriteMessage split a data message larger than n
+// bytes in frames of at most n bytes, e.g. for a peer limiting its frame
+// size. The frames go out back to back under the write lock. Zero, the
+// default, writes every message in a single frame.
+func (c *Conn) SetMaxWriteFrameSize(n int) {
+	c.wmu.Lock()
+	c.maxWriteFrame = n
+	c.wmu.Unlock()
+}
+
+// SetAutoFlush sets whether data frames are flushed as they are written, on
+// by default. When off they stay buffered until Flush, or until the write
+// buffer is full, so several WriteMessage calls can go out as one write.
+// Control frames are always flushed.
+func (c *Conn) SetAutoFlush(on bool) {
+	c.wmu.Lock()
+	c.manualFlush = !on
+	c.wmu.Unlock()
+}
+
+// SetWriteCoalescing buffers written data frames and sends them together
+// once size bytes are pending or delay after the first one, whichever comes
+// first, so bursts of small messages cost fewer writes. Control frames are
+// always sent at once. Call Flush to send pending frames earlier, e.g. before
+// Close. A zero delay turns it off.
+func (c *Conn) SetWriteCoalescing(delay time.Duration, size int) {
+	c.wmu.Lock()
+	c.coalesceDelay, c.coalesceSize = delay, size
+	c.wmu.Unlock()
+	if delay == 0 {
+		c.Flush()
+	}
+}
+
+// SetMaskRand sets the source the mask keys of a client Conn are read from,
+// e.g. a fixed one to make the written frames reproducible in tests. A read
+// error from r breaks the connection like a write error. A nil r restores
+// crypto/rand, the default.
+func (c *Conn) SetMaskRand(r io.Reader) {
+	if r == nil {
+		r = rand.Reader
+	}
+	c.maskRand = r
+}
+
+// SetUnsafeCounterMask makes a client Conn use mask keys 1, 2, 3 and so on,
+// big endian, instead of random ones, so frames can be matched against a
+// capture. Predictable keys defeat the point of masking, it's for tests
+// only. Turning it off restores crypto/rand.
+func (c *Conn) SetUnsafeCounterMask(on bool) {
+	if on {
+		c.SetMaskRand(new(counterMask))
+	} else {
+		c.SetMaskRand(nil)
+	}
+}
+
+// counterMask is the mask key source of SetUnsafeCounterMask.
+type counterMask struct {
+	n uint32
+}
+
+// Read fills p with the next keys, one per 4 bytes.
+func (m *counterMask) Read(p []byte) (int, error) {
+	var b [4]byte
+	for i := 0; i < len(p); i += 4 {
+		m.n++
+		binary.BigEndian.PutUint32(b[:], m.n)
+		copy(p[i:], b[:])
+	}
+	return len(p), nil
+}
+
+// SetPongHandler sets the handler called by ReadMessage for each pong with
+// its payload, an error from it is returned by ReadMessage.
+func (c *Conn) SetPongHandler(h func(appData string) error) {
+	c.pongHandler = h
+}
+
+// SetIdleTimeout sets the read deadline d from now and pushes it forward
+// every time a frame is read, so a peer silent for longer than d makes
+// ReadMessage fail. Zero stops pushing the deadline, it doesn't clear it.
+func (c *Conn) SetIdleTimeout(d time.Duration) error {
+	c.idleTimeout = d
+	if d > 0 {
+		return c.SetReadDeadline(time.Now().Add(d))
+	}
+	return nil
+}
+
+// SetValidateUTF8 sets whether text messages read with NextReader are
+// checked to be valid UTF-8 as their fragments arrive.
+func (c *Conn) SetValidateUTF8(on bool) {
+	c.validateUTF8 = on
+}
+
+// SetProtocolMode sets StrictMode or LenientMode. In LenientMode these
+// checks are downgraded from errors to logged warnings:
+//
+//   - reserved bits RSV1, RSV2 or RSV3 set on a frame;
+//   - control frames with a payload longer than 125 bytes, a ping is then
+//     answered with a pong of its first 125 bytes and a close echoed
+//     with its code alone.
+//
+// All other violations are fatal in both modes.
+func (c *Conn) SetProtocolMode(mode int) {
+	c.mode = mode
+}
+
+// violation returns err in StrictMode, in LenientMode err is logged and
+// dropped.
+func (c *Conn) violation(err error) error {
+	if c.mode != LenientMode {
+		return err
+	}
+	log.Printf("websocket: ignore protocol violation: %v", err)
+	return nil
+}
+
+// WriteMessage write a message by type. A control message goes through
+// WriteControl, with its checks and the closing state of a CloseFrame.
+func (c *Conn) WriteMessage(op int, payload []byte) (err error) {
+	if err = checkWriteOp(op); err != nil {
+		return
+	}
+	if op >= CloseFrame {
+		return c.WriteControl(op, payload, c.lastWriteDeadline())
+	}
+	if c.wlimit != nil {
+		if err = c.wlimit.wait(len(payload), c.lastWriteDeadline()); err != nil {
+			return
+		}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closing {
+		return ErrConnClosing
+	}
+	if c.writing {
+		return ErrWriterOpen
+	}
+	return c.writeFrame(op, payload)
+}
+
+// WriteMessageWithDeadline is WriteMessage with the write deadline set to
+// deadline for this message only, the one set by SetWriteDeadline is restored
+// afterwards.
+func (c *Conn) WriteMessageWithDeadline(op int, payload []byte, deadline time.Time) (err error) {
+	if err = checkWriteOp(op); err != nil {
+		return
+	}
+	if op >= CloseFrame {
+		return c.WriteControl(op, payload, deadline)
+	}
+	if c.wlimit != nil {
+		if err = c.wlimit.wait(len(payload), deadline); err != nil {
+			return
+		}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closing {
+		return ErrConnClosing
+	}
+	if c.writing {
+		return ErrWriterOpen
+	}
+	if err = c.setWriteDeadline(deadline); err != nil {
+		return
+	}
+	err = c.writeFrame(op, payload)
+	if derr := c.setWriteDeadline(c.writeDeadline); err == nil {
+		err = derr
+	}
+	return
+}
+
+// WriteMessageFrom writes the chunks one after the other as a single frame
+// message of type op, without joining them first. The chunks of a control
+// message are joined and written by WriteControl.
+func (c *Conn) WriteMessageFrom(op int, chunks ...[]byte) (err error) {
+	if err = checkWriteOp(op); err != nil {
+		return
+	}
+	if op >= CloseFrame {
+		var p []byte
+		for _, chunk := range chunks {
+			if p = append(p, chunk...); len(p) > maxControlPayload {
+				return ErrControlTooLarge
+			}
+		}
+		return c.WriteControl(op, p, c.lastWriteDeadline())
+	}
+	if c.wlimit != nil {
+		n := 0
+		for _, p := range chunks {
+			n += len(p)
+		}
+		if err = c.wlimit.wait(n, c.lastWriteDeadline()); err != nil {
+			return
+		}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closing {
+		return ErrConnClosing
+	}
+	if c.writing {
+		return ErrWriterOpen
+	}
+	return c.writeFragment(true, op, chunks...)
+}
+
+// Do writes a message, flushing it, and reads the next one, both within
+// timeout, for simple request/reply use. It isn't safe while another
+// goroutine reads from the Conn, which could take the reply. The reply is
+// owned like a ReadMessage payload. A zero timeout leaves the deadlines as
+// they are.
+func (c *Conn) Do(op int, payload []byte, timeout time.Duration) (rop int, reply []byte, err error) {
+	if timeout <= 0 {
+		err = c.WriteMessage(op, payload)
+	} else {
+		err = c.WriteMessageWithDeadline(op, payload, time.Now().Add(timeout))
+	}
+	if err != nil {
+		return
+	}
+	if err = c.Flush(); err != nil {
+		return
+	}
+	if timeout > 0 {
+		t := time.Now().Add(timeout)
+		if !c.readDeadline.IsZero() && c.readDeadline.Before(t) {
+			t = c.readDeadline
+		}
+		if err = c.setReadDeadline(t); err != nil {
+			return
+		}
+		defer func() {
+			if derr := c.setReadDeadline(c.readDeadline); err == nil {
+				err = derr
+			}
+		}()
+	}
+	return c.ReadMessage()
+}
+
+// Broken returns the write error that broke the connection, if any.
+func (c *Conn) Broken() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.werr
+}
+
+// writeFrame write a whole message and flush it, in frames of maxWriteFrame
+// bytes for a larger data message, caller must hold wmu.
+func (c *Conn) writeFrame(op int, payload []byte) error {
+	if size := c.maxWriteFrame; size > 0 && op <= BinaryFrame {
+		for ; len(payload) > size; payload = payload[size:] {
+			if err := c.writeFragment(false, op, payload[:size]); err != nil {
+				return err
+			}
+			op = continuationFrame
+		}
+	}
+	return c.writeFragment(true, op, payload)
+}
+
+// writeFragment write a frame whose payload is the chunks one after the other
+// and flush it, caller must hold wmu.
+func (c *Conn) writeFragment(fin bool, op int, chunks ...[]byte) (err error) {
+	if c.werr != nil {
+		return c.werr
+	}
+	defer func() {
+		if err != nil {
+			c.werr = err
+		} else {
+			countFrame(&c.writeFrames, op)
+		}
+	}()
+	h := FrameHeader{Fin: fin, Op: op}
+	for _, p := range chunks {
+		h.Length += int64(len(p))
+	}
+	if c.client {
+		h.Masked = true
+		if _, err = io.ReadFull(c.maskRand, h.MaskKey[:]); err != nil {
+			return
+		}
+	}
+	if err = EncodeHeader(c.wtr, h); err != nil {
+		return
+	}
+	// the mask carries on across chunks
+	pos := 0
+	for _, p := range chunks {
+		if h.Masked {
+			pos, err = c.writeMasked(h.MaskKey, pos, p)
+		} else if len(p) > 0 {
+			_, err = c.wtr.Write(p)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return c.flushFrame(op)
+}
+
+// flushFrame flushes the frame of type op just buffered, unless data frames
+// are left buffered by SetAutoFlush or SetWriteCoalescing. Caller must hold
+// wmu.
+func (c *Conn) flushFrame(op int) error {
+	if c.manualFlush && op < CloseFrame {
+		return nil
+	}
+	if c.coalesceDelay > 0 && op < CloseFrame {
+		return c.coalesce()
+	}
+	return c.wtr.Flush()
+}
+
+// coalesce leaves the data frames just written in the buffer, flushing once
+// coalesceSize bytes are pending or coalesceDelay after the first of them.
+// Caller must hold wmu.
+func (c *Conn) coalesce() error {
+	if c.wtr.Buffered() >= c.coalesceSize {
+		return c.wtr.Flush()
+	}
+	if c.flushTimer == nil {
+		c.flushTimer = time.AfterFunc(c.coalesceDelay, func() {
+			c.Flush()
+		})
+	}
+	return nil
+}
+
+// Flush writes any buffered frames to the underlying connection.
+func (c *Conn) Flush() (err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	if c.werr != nil {
+		return c.werr
+	}
+	if err = c.wtr.Flush(); err != nil {
+		c.werr = err
+	}
+	return
+}
+
+// writeMasked masks payload into the write buffer from the mask position
+// pos, leaving payload itself untouched. It returns the position to carry on
+// from.
+func (c *Conn) writeMasked(key [4]byte, pos int, payload []byte) (int, error) {
+	for len(payload) > 0 {
+		n := c.wtr.Available()
+		if n == 0 {
+			if err := c.wtr.Flush(); err != nil {
+				return pos, err
+			}
+			continue
+		}
+		if n > len(payload) {
+			n = len(payload)
+		}
+		b, err := c.wtr.Peek(n)
+		if err != nil {
+			return pos, err
+		}
+		copy(b, payload[:n])
+		pos = maskBytes(key[:], pos, b)
+		payload = payload[n:]
+	}
+	return pos, nil
+}
+
+// WriteControl write a control frame of type op with the given deadline, a
+// zero deadline means no deadline. The payload must be 125 bytes or less.
+// Writing a CloseFrame puts the connection in the closing state. While a
+// NextWriter message is open the frame is written between its fragments.
+func (c *Conn) WriteControl(op int, payload []byte, deadline time.Time) (err error) {
+	if op != CloseFrame && op != PingFrame && op != PongFrame {
+		return fmt.Errorf("not a control message, op=%d", op)
+	}
+	if len(payload) > maxControlPayload {
+		return ErrControlTooLarge
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closing {
+		return ErrConnClosing
+	}
+	if op == CloseFrame {
+		c.closing = true
+	}
+	if err = c.setWriteDeadline(deadline); err != nil {
+		return
+	}
+	err = c.writeFrame(op, payload)
+	if derr := c.setWriteDeadline(c.writeDeadline); err == nil {
+		err = derr
+	}
+	return
 }
 
-// ReadMessage read a message.
+// checkWriteOp returns an error for an op no message can be written with,
+// a continuation or a reserved one.
+func checkWriteOp(op int) error {
+	switch op {
+	case TextFrame, BinaryFrame, CloseFrame, PingFrame, PongFrame:
+		return nil
+	}
+	return fmt.Errorf("invalid message type, op=%d", op)
+}
+
+// Ping write a ping control message.
+func (c *Conn) Ping(data []byte, deadline time.Time) error {
+	return c.WriteControl(PingFrame, data, deadline)
+}
+
+// Pong write a pong control message.
+func (c *Conn) Pong(data []byte, deadline time.Time) error {
+	return c.WriteControl(PongFrame, data, deadline)
+}
+
+// setReadDeadline set the read deadline if rwc supports deadlines.
+func (c *Conn) setReadDeadline(t time.Time) error {
+	if d, ok := c.rwc.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// setWriteDeadline set the write deadline if rwc supports deadlines.
+func (c *Conn) setWriteDeadline(t time.Time) error {
+	if d, ok := c.rwc.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// closeWrite marks the connection closing and echoes the close frame once
+// any in-progress frame has been written. The payload is the unmasked one
+// from decodeFrame, the echo is masked only if this Conn is a client.
+func (c *Conn) closeWrite(payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closing {
+		return nil
+	}
+	c.closing = true
+	return c.writeFrame(CloseFrame, payload)
+}
+
+// DrainUntilClose reads and discards the frames the peer sends until its
+// close, e.g. after writing a close frame and before Close. It returns nil
+// once the close is read, or the read error, an os.ErrDeadlineExceeded one if
+// the close doesn't come by deadline. The read deadline is restored
+// afterwards.
+func (c *Conn) DrainUntilClose(deadline time.Time) (err error) {
+	c.reader = nil
+	c.resetMessage()
+	if err = c.setReadDeadline(deadline); err != nil {
+		return
+	}
+	defer func() {
+		if derr := c.setReadDeadline(c.readDeadline); err == nil {
+			err = derr
+		}
+	}()
+	for {
+		if _, _, _, err = c.readFrame(false, false, nil, 0, 0); err != nil {
+			if _, ok := err.(*CloseError); ok {
+				return nil
+			}
+			return
+		}
+	}
+}
+
+// Close close the connection, a ReadMessage blocked on it returns
+// ErrConnClosed. Closing it again does nothing and returns ErrConnClosed.
+func (c *Conn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return ErrConnClosed
+	}
+	c.pauseMu.Lock()
+	c.pauseCond.Broadcast()
+	c.pauseMu.Unlock()
+	return c.rwc.Close()
+}
+
+// CloseWithMessage writes a close frame with code and text within
+// closeWriteWait, then closes the connection. A single close frame ever goes
+// on the wire: if one was already written, by WriteControl, the echo of the
+// peer's close or an earlier call, only the connection is closed. After Close
+// it fails with ErrConnClosed.
+func (c *Conn) CloseWithMessage(code int, text string) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrConnClosed
+	}
+	err := c.WriteControl(CloseFrame, FormatCloseMessage(code, text), time.Now().Add(closeWriteWait))
+	if err == ErrConnClosing {
+		err = nil
+	}
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// CloseBestEffort writes a close frame with code and text, then closes the
+// connection, for shutdown paths that must not hang. The close frame write
+// gets closeWriteWait, the same deadline unblocks a write in progress, and
+// its failure is ignored, only the error of closing rwc is returned. After a
+// write error the frame goes straight to rwc, the peer may get it after a
+// torn frame. A text too long for a close frame is left out.
+func (c *Conn) CloseBestEffort(code int, text string) error {
+	payload := FormatCloseMessage(code, text)
+	if len(payload) > maxControlPayload {
+		payload = FormatCloseMessage(code, "")
+	}
+	c.setWriteDeadline(time.Now().Add(closeWriteWait))
+	c.wmu.Lock()
+	if !c.closing {
+		c.closing = true
+		if c.werr == nil {
+			c.writeFrame(CloseFrame, payload)
+		} else {
+			var (
+				b   bytes.Buffer
+				err error
+				h   = FrameHeader{Fin: true, Op: CloseFrame, Masked: c.client}
+			)
+			if h.Masked {
+				_, err = io.ReadFull(c.maskRand, h.MaskKey[:])
+			}
+			if err == nil {
+				WriteFrameTo(&b, h, payload)
+				if _, err = c.rwc.Write(b.Bytes()); err == nil {
+					countFrame(&c.writeFrames, CloseFrame)
+				}
+			}
+		}
+	}
+	c.wmu.Unlock()
+	return c.Close()
+}
+
+// resetMessage drops the message being reassembled and gives its bytes back
+// to the reassembly budget.
+func (c *Conn) resetMessage() {
+	if c.msgReserved > 0 {
+		c.budget.release(c.msgReserved)
+	}
+	c.msgOp, c.msg, c.msgReserved, c.msgFrames = 0, nil, 0, fragmentCount{}
+}
+
+// Reset makes c a fresh Conn over rwc so it can be reused, e.g. from a
+// pool. The buffers and the settings are kept, the per-connection state
+// (mask key, deadlines, RTT, Stats counters, close and error state) is
+// cleared. It fails with
+// ErrMessageOpen while a message is still being read or written.
+func (c *Conn) Reset(rwc io.ReadWriteCloser) error {
+	if c.msgOp != 0 || (c.reader != nil && (!c.reader.fin || len(c.reader.buf) > 0)) {
+		return ErrMessageOpen
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.writing {
+		return ErrMessageOpen
+	}
+	switch r := c.rdr.(type) {
+	case *bufio.Reader:
+		r.Reset(rwc)
+	case stdReader:
+		r.Reset(rwc)
+	}
+	c.wtr.Reset(rwc)
+	c.rwc = rwc
+	for i := range c.maskKey {
+		c.maskKey[i] = 0
+	}
+	c.resetMessage()
+	c.reader = nil
+	c.readDeadline, c.writeDeadline = time.Time{}, time.Time{}
+	c.ctrlStart, c.ctrlCount = time.Time{}, 0
+	c.rttMu.Lock()
+	c.rtt = rttStats{}
+	c.rttMu.Unlock()
+	atomic.StoreInt64(&c.reallocs, 0)
+	for op := range c.readFrames {
+		atomic.StoreInt64(&c.readFrames[op], 0)
+		atomic.StoreInt64(&c.writeFrames[op], 0)
+	}
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	c.closing, c.werr, c.closeErr, c.rerr = false, nil, nil, nil
+	c.pauseMu.Lock()
+	c.paused = false
+	c.pauseMu.Unlock()
+	atomic.StoreInt32(&c.closed, 0)
+	return nil
+}
+
+// ReadMessage read a message. Ping, pong and close frames are handled
+// internally unless SetReturnControl is on, then they are returned as is and
+// a message interrupted by them is resumed by the next ReadMessage. A close
+// before the final frame of a message fails with an error matching
+// ErrMessageIncomplete, errors.As still finds the *CloseError in it.
+//
+// Fragments are read straight into a buffer the Conn keeps across messages,
+// the payload is copied out of it unless SetCopyPayload is off, then it is
+// only valid until the next ReadMessage or NextReader call. It never aliases
+// the read buffer, a returned control frame payload is a copy of its own.
 func (c *Conn) ReadMessage() (op int, payload []byte, err error) {
+	op, payload, _, err = c.readMessage()
+	return
+}
+
+// ReadMessageFrames is ReadMessage also returning the number of frames the
+// message was made of, one for a control frame.
+func (c *Conn) ReadMessageFrames() (op int, payload []byte, frames int, err error) {
+	return c.readMessage()
+}
+
+func (c *Conn) readMessage() (op int, payload []byte, frames int, err error) {
 	var (
-		fin         bool
-		finOp, n    int
-		partPayload []byte
+		fin bool
+		off int
 	)
+	defer func() {
+		if err != nil {
+			payload = nil
+			c.resetMessage()
+		}
+	}()
+	if err = c.discardReader(); err != nil {
+		return
+	}
 	for {
-		// read frame
-		if fin, op, partPayload, err = c.decodeFrame(); err != nil {
+		// read frame, appended to the message read so far
+		off = len(c.msg)
+		if fin, op, payload, err = c.readFrame(c.returnControl, true, c.msgBuf(), c.msgOp, int64(off)); err != nil {
+			if c.msgOp != 0 {
+				err = incomplete(err)
+			}
+			return
+		}
+		if op == PingFrame || op == PongFrame || op == CloseFrame {
+			// a control payload aliases the read buffer, the next frame
+			// read would overwrite it
+			return op, append([]byte(nil), payload...), 1, nil
+		}
+		// one message at a time, a data frame can't start a new one before
+		// the FIN of the current one
+		if c.msgOp != 0 && op != continuationFrame {
+			err = protocolError(CloseProtocolError, fmt.Errorf("unexpected data frame in message, op=%d", op))
+			return
+		}
+		if c.msgOp == 0 && op == continuationFrame {
+			err = protocolError(CloseProtocolError, fmt.Errorf("unexpected continuation frame"))
+			return
+		}
+		if op == continuationFrame {
+			if err = c.msgFrames.add(c, len(payload)-off); err != nil {
+				return
+			}
+		}
+		c.crossSoftLimit(int64(off), int64(len(payload)))
+		// single frame message, a message started by empty fragments
+		// must still go through reassembly to keep its op
+		if fin && c.msgOp == 0 {
+			return op, c.keepBuf(payload), 1, nil
+		}
+		// continuation frame, its bytes already taken from the budget
+		c.msg = payload
+		if op != continuationFrame {
+			c.msgOp = op
+		}
+		// final frame
+		if fin {
+			op, payload, frames = c.msgOp, c.keepBuf(c.msg), c.msgFrames.frames+1
+			c.resetMessage()
+			return
+		}
+	}
+}
+
+// msgBuf returns the buffer the next fragment of the message is appended to,
+// the retained one for a new message.
+func (c *Conn) msgBuf() []byte {
+	if c.msg != nil {
+		return c.msg
+	}
+	if c.rbuf == nil {
+		c.rbuf = make([]byte, 0, c.sizeHint)
+	}
+	return c.rbuf[:0]
+}
+
+// keepBuf retains the buffer of a returned message for the next one, unless
+// it is larger than maxRetainedRead. It returns the payload to hand out, a
+// copy with copyPayload unless the buffer isn't retained.
+func (c *Conn) keepBuf(b []byte) []byte {
+	if cap(b) > maxRetainedRead {
+		// rbuf may be b, e.g. preallocated from a large size hint, the
+		// next message must not be read over the one handed out
+		c.rbuf = nil
+		return b
+	}
+	c.rbuf = b[:0]
+	if !c.copyPayload {
+		return b
+	}
+	p := make([]byte, len(b))
+	copy(p, b)
+	return p
+}
+
+// readFrame reads the next data frame, handling the control frames met on
+// the way. With ctrl set control frames are returned instead. A data frame
+// payload is appended to dst and reserve takes it from the reassembly
+// budget, see decodeFrame. Once a close is read nothing
+// more is, the peer must not send anything after it.
+func (c *Conn) readFrame(ctrl, reserve bool, dst []byte, msgOp int, n int64) (fin bool, op int, payload []byte, err error) {
+	if c.closeErr != nil {
+		return false, 0, nil, c.closeErr
+	}
+	if c.rerr != nil {
+		return false, 0, nil, c.rerr
+	}
+	for {
+		if err = c.waitReads(); err != nil {
+			return
+		}
+		if fin, op, payload, err = c.decodeFrame(reserve, dst, msgOp, n); err != nil {
+			if atomic.LoadInt32(&c.closed) == 1 {
+				err = ErrConnClosed
+			}
+			return
+		}
+		if c.idleTimeout > 0 {
+			if err = c.SetReadDeadline(time.Now().Add(c.idleTimeout)); err != nil {
+				return
+			}
+		}
+		if op >= CloseFrame && c.ctrlLimit > 0 {
+			if err = c.countControl(); err != nil {
+				return
+			}
+		}
+		if ctrl && (op == PingFrame || op == PongFrame || op == CloseFrame) {
+			if op == CloseFrame {
+				c.closeErr = closeReadError(payload)
+			}
 			return
 		}
 		switch op {
 		case BinaryFrame, TextFrame, continuationFrame:
-			if fin && len(payload) == 0 {
-				return op, partPayload, nil
+			return
+		case PingFrame:
+			// handler ping, the pong goes through WriteControl like any
+			// other control frame so it can't split a concurrent write,
+			// an oversized ping let through by LenientMode is truncated
+			if len(payload) > maxControlPayload {
+				payload = payload[:maxControlPayload]
 			}
-			// continuation frame
-			payload = append(payload, partPayload...)
-			if op != continuationFrame {
-				finOp = op
+			err = c.WriteControl(PongFrame, payload, time.Now().Add(pongWriteWait))
+			if err == ErrConnClosing {
+				err = nil
 			}
-			// final frame
-			if fin {
-				op = finOp
+			if err != nil {
 				return
 			}
-		case PingFrame:
-			// handler ping
 		case PongFrame:
 			// handler pong
+			c.recordRTT(payload)
+			if c.pongHandler != nil {
+				if err = c.pongHandler(string(payload)); err != nil {
+					return
+				}
+			}
 		case CloseFrame:
 			// handler close
-			err = ErrMessageClose
-			return
-		default:
-			err = fmt.Errorf("unknown control message, fin=%t, op=%d", fin, op)
-			return
-		}
-		if n > continuationFrameMaxRead {
-			err = ErrMessageMaxRead
+			err = closeReadError(payload)
+			if ce, ok := err.(*CloseError); ok {
+				// an oversized close let through by LenientMode can't be
+				// echoed whole, its text is dropped
+				if len(payload) > maxControlPayload {
+					payload = FormatCloseMessage(ce.Code, "")
+				}
+				c.closeWrite(payload)
+			} else {
+				c.closeWrite(FormatCloseMessage(CloseProtocolError, ""))
+			}
+			c.closeErr = err
 			return
 		}
-		n++
 	}
 }
 
-func (c *Conn) decodeFrame() (bool, int, []byte, error) {
-	var (
-		b          byte
-		s          []byte
-		mask       bool
-		maskKey    []byte
-		payloadLen int64
-		fin        bool
-		op         int
-		payload    []byte
-		err        error
-	)
-	// 1.First byte. FIN/RSV1/RSV2/RSV3/OpCode(4bits)
-	b, err = c.rdr.ReadByte()
-	if err != nil {
-		return fin, op, payload, err
+// countControl counts a control frame read, closing the connection with
+// ClosePolicyViolation once more than ctrlLimit arrive within ctrlWindow.
+// The error is kept in closeErr so every later read fails with it.
+func (c *Conn) countControl() error {
+	if now := time.Now(); c.ctrlStart.IsZero() || (c.ctrlWindow > 0 && now.Sub(c.ctrlStart) >= c.ctrlWindow) {
+		c.ctrlStart, c.ctrlCount = now, 0
+	}
+	if c.ctrlCount++; c.ctrlCount <= c.ctrlLimit {
+		return nil
 	}
-	// final frame
-	fin = (b & finBit) != 0
+	c.closeWrite(FormatCloseMessage(ClosePolicyViolation, ""))
+	c.closeErr = protocolError(ClosePolicyViolation, ErrControlFlood)
+	c.Close()
+	return c.closeErr
+}
 
-	// rsv MUST be 0
-	if rsv := b & (rsv1Bit | rsv2Bit | rsv3Bit); rsv != 0 {
-		err = fmt.Errorf("unexpected reserved bits rsv1=%d, rsv2=%d, rsv3=%d", b&rsv1Bit, b&rsv2Bit, b&rsv3Bit)
-		fmt.Printf("%s", err)
-		return false, 0, nil, err
+// decodeFrame reads a frame. The payload of a data frame is appended to dst
+// and returned with it, a nil dst lets it alias the read buffer when payloads
+// are read at once. Control frame payloads are always read on their own. n is
+// the size of the message of type msgOp before the frame, checked with the
+// frame against the read limit before its payload is read. With reserve the
+// payload of a frame belonging to a reassembled message, not a single frame
+// one, is acquired from the reassembly budget before it is read, and added
+// to msgReserved.
+func (c *Conn) decodeFrame(reserve bool, dst []byte, msgOp int, n int64) (fin bool, op int, payload []byte, err error) {
+	var h FrameHeader
+	if h, err = decodeHeader(c.rdr, c.hdr[:], c.minimalLength); err != nil {
+		return
 	}
+	fin, op = h.Fin, h.Op
 
-	// op code
-	op = int(b & opCode)
+	// opcodes 3-7 and 11-15 are reserved, whether or not a message is in
+	// progress
+	if (op > BinaryFrame && op < CloseFrame) || op > PongFrame {
+		return fin, op, nil, protocolError(CloseProtocolError, fmt.Errorf("reserved opcode, fin=%t, op=%d", fin, op))
+	}
+	// rsv MUST be 0
+	if h.Rsv1 || h.Rsv2 || h.Rsv3 {
+		err = protocolError(CloseProtocolError, fmt.Errorf("unexpected reserved bits rsv1=%t, rsv2=%t, rsv3=%t", h.Rsv1, h.Rsv2, h.Rsv3))
+		if err = c.violation(err); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	// the length must fit an int before it is used to read the payload
+	if h.Length > maxInt || (c.maxFrameSize > 0 && h.Length > c.maxFrameSize) {
+		return fin, op, nil, protocolError(CloseMessageTooBig, ErrFrameTooLarge)
+	}
+	// limits apply to every data frame whatever the message type
+	if op != continuationFrame {
+		msgOp = op
+	}
+	if limit := c.limitFor(msgOp); op <= BinaryFrame && limit > 0 && h.Length > limit-n {
+		return fin, op, nil, protocolError(CloseMessageTooBig, ErrReadLimit)
+	}
+	// control frames MUST have a payload length of 125 bytes or less
+	if op >= CloseFrame {
+		if h.Length > maxControlPayload {
+			err = protocolError(CloseProtocolError, fmt.Errorf("control frame too large, op=%d, len=%d", op, h.Length))
+			if err = c.violation(err); err != nil {
+				return fin, op, nil, err
+			}
+		}
+		dst = nil
+	}
 
-	// 2.Second byte. Mask/Payload len(7bits)
-	b, err = c.rdr.ReadByte()
-	if err != nil {
-		return fin, op, nil, err
+	// mask key, a server MUST NOT mask the frames it sends
+	if h.Masked && c.client {
+		return fin, op, nil, protocolError(CloseProtocolError, fmt.Errorf("masked frame from server, op=%d", op))
 	}
-	// is mask payload
-	mask = (b & maskBit) != 0
-	// payload length
-	switch b & lenBit {
-	case 126:
-		// 16 bits
-		if s, err = c.rdr.Pop(2); err != nil {
+	if h.Masked {
+		if c.maskKey == nil {
+			c.maskKey = make([]byte, 4)
+		}
+		copy(c.maskKey, h.MaskKey[:])
+	}
+	// with reserve a fragment of a message to reassemble takes its bytes
+	// from the budget before the buffer grows for them
+	if reserve && c.budget != nil && op <= BinaryFrame && (!fin || op == continuationFrame) && h.Length > 0 {
+		if err = c.budget.acquire(h.Length); err != nil {
 			return fin, op, nil, err
 		}
-		payloadLen = int64(binary.BigEndian.Uint16(s))
-	case 127:
-		// 64 bits
-		if s, err = c.rdr.Pop(8); err != nil {
+		c.msgReserved += h.Length
+	}
+	// the read rate is paid before the payload is read, the header is gone
+	// already so a read outlasting the deadline leaves the Conn unreadable
+	if c.rlimit != nil && op <= BinaryFrame && h.Length > 0 {
+		if err = c.rlimit.wait(int(h.Length), c.readDeadline); err != nil {
+			c.rerr = err
 			return fin, op, nil, err
 		}
-		payloadLen = int64(binary.BigEndian.Uint64(s))
-	default:
-		// 7 bits
-		payloadLen = int64(b & lenBit)
 	}
+	// read payload
+	off := len(dst)
+	read := c.readPayload
+	if c.frameTimeout > 0 && h.Length > 0 {
+		read = c.readPayloadTimeout
+	}
+	if payload, err = read(dst, h.Length); err != nil {
+		// the frame is partly read, what follows can't be parsed
+		c.rerr = err
+		return fin, op, nil, err
+	}
+	countFrame(&c.readFrames, op)
+	if h.Masked {
+		maskBytes(c.maskKey, 0, payload[off:])
+	}
+	return
+}
 
-	// read mask key
-	if mask {
-		maskKey, err = c.rdr.Pop(4)
-		if err != nil {
-			return fin, op, nil, err
+// readPayloadTimeout is readPayload within the frame timeout, the read
+// deadline set by the caller is restored afterwards.
+func (c *Conn) readPayloadTimeout(dst []byte, n int64) (payload []byte, err error) {
+	t := time.Now().Add(c.frameTimeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(t) {
+		t = c.readDeadline
+	}
+	if err = c.setReadDeadline(t); err != nil {
+		return
+	}
+	payload, err = c.readPayload(dst, n)
+	if derr := c.setReadDeadline(c.readDeadline); err == nil {
+		err = derr
+	}
+	return
+}
+
+// readPayload appends n payload bytes to dst. Chunked reads take at most
+// readChunk at a time, so the buffer only grows as fast as the peer actually
+// delivers data, lengths up to the size hint are trusted and allocated at
+// once. Growing a non-nil dst counts as a reallocation in Stats.
+func (c *Conn) readPayload(dst []byte, n int64) (payload []byte, err error) {
+	if n == 0 {
+		return dst, nil
+	}
+	if c.readChunk <= 0 {
+		var p []byte
+		if p, err = c.rdr.Pop(int(n)); err != nil || dst == nil {
+			return p, err
 		}
-		if c.maskKey == nil {
-			c.maskKey = make([]byte, 4)
+		if payload = append(dst, p...); cap(payload) != cap(dst) {
+			atomic.AddInt64(&c.reallocs, 1)
 		}
-		copy(c.maskKey, maskKey)
+		return payload, nil
 	}
-	// read payload
-	if payloadLen > 0 {
-		if payload, err = c.rdr.Pop(int(payloadLen)); err != nil {
-			return fin, op, nil, err
+	var grows int64
+	payload = dst
+	if n <= int64(c.sizeHint) && int64(cap(payload)-len(payload)) < n {
+		payload = append(make([]byte, 0, int64(len(payload))+n), payload...)
+		grows++
+	}
+	for n > 0 {
+		chunk := n
+		if chunk > int64(c.readChunk) {
+			chunk = int64(c.readChunk)
 		}
-		if mask {
-			maskBytes(c.maskKey, 0, payload)
+		off, size := len(payload), cap(payload)
+		if payload = append(payload, make([]byte, chunk)...); cap(payload) != size {
+			grows++
 		}
+		if _, err = io.ReadFull(c.rdr, payload[off:]); err != nil {
+			return nil, err
+		}
+		n -= chunk
+	}
+	if dst != nil && grows > 0 {
+		atomic.AddInt64(&c.reallocs, grows)
 	}
-	return fin, op, nil, err
+	return payload, nil
 }
 
 func maskBytes(key []byte, pos int, b []byte) int {
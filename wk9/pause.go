@@ -0,0 +1,37 @@
+package wk9
+
+import (
+	"sync/atomic"
+)
+
+// PauseReads makes reads block before their next frame until ResumeReads,
+// so the peer is held back by TCP flow control once the buffers fill up.
+// Nothing is read while paused, control frames included: pings are answered
+// and closes echoed only after ResumeReads. Close unblocks paused reads,
+// which fail with ErrConnClosed.
+func (c *Conn) PauseReads() {
+	c.pauseMu.Lock()
+	c.paused = true
+	c.pauseMu.Unlock()
+}
+
+// ResumeReads lets the reads blocked by PauseReads carry on.
+func (c *Conn) ResumeReads() {
+	c.pauseMu.Lock()
+	c.paused = false
+	c.pauseMu.Unlock()
+	c.pauseCond.Broadcast()
+}
+
+// waitReads blocks while reads are paused.
+func (c *Conn) waitReads() error {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	for c.paused && atomic.LoadInt32(&c.closed) == 0 {
+		c.pauseCond.Wait()
+	}
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrConnClosed
+	}
+	return nil
+}
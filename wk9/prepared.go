@@ -0,0 +1,67 @@
+package wk9
+
+import (
+	"bytes"
+)
+
+// PreparedMessage is a message whose frame is encoded once, so writing it to
+// many server Conns costs a single copy each.
+type PreparedMessage struct {
+	op    int
+	data  []byte
+	frame []byte
+}
+
+// NewPreparedMessage returns a prepared message of type op, data is copied so
+// the caller can reuse it right away.
+func NewPreparedMessage(op int, data []byte) (*PreparedMessage, error) {
+	if err := checkWriteOp(op); err != nil {
+		return nil, err
+	}
+	if op >= CloseFrame && len(data) > maxControlPayload {
+		return nil, ErrControlTooLarge
+	}
+	var b bytes.Buffer
+	if err := EncodeHeader(&b, FrameHeader{Fin: true, Op: op, Length: int64(len(data))}); err != nil {
+		return nil, err
+	}
+	b.Write(data)
+	// data is kept as the payload of the frame, not the caller's slice,
+	// client Conns encode it again once the caller may have reused it
+	frame := b.Bytes()
+	return &PreparedMessage{op: op, data: frame[len(frame)-len(data):], frame: frame}, nil
+}
+
+// WritePreparedMessage write a prepared message. A client Conn has to mask
+// every frame, so it encodes the message again, and a control message goes
+// through WriteControl like with WriteMessage.
+func (c *Conn) WritePreparedMessage(pm *PreparedMessage) (err error) {
+	if c.client || pm.op >= CloseFrame {
+		return c.WriteMessage(pm.op, pm.data)
+	}
+	if c.wlimit != nil {
+		if err = c.wlimit.wait(len(pm.data), c.lastWriteDeadline()); err != nil {
+			return
+		}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closing {
+		return ErrConnClosing
+	}
+	if c.writing {
+		return ErrWriterOpen
+	}
+	if c.werr != nil {
+		return c.werr
+	}
+	if _, err = c.wtr.Write(pm.frame); err == nil {
+		err = c.flushFrame(pm.op)
+	}
+	if err != nil {
+		c.werr = err
+	} else {
+		countFrame(&c.writeFrames, pm.op)
+	}
+	return
+}
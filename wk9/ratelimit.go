@@ -0,0 +1,50 @@
+package wk9
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket counting bytes.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &rateLimiter{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait takes n tokens and sleeps until the bucket has paid for them. If that
+// is after a non-zero deadline it returns os.ErrDeadlineExceeded at once and
+// takes nothing.
+func (l *rateLimiter) wait(n int, deadline time.Time) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	var d time.Duration
+	if need := float64(n) - l.tokens; need > 0 {
+		d = time.Duration(need / l.rate * float64(time.Second))
+	}
+	if d > 0 && !deadline.IsZero() && now.Add(d).After(deadline) {
+		l.mu.Unlock()
+		return os.ErrDeadlineExceeded
+	}
+	l.tokens -= float64(n)
+	l.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+	return nil
+}
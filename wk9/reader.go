@@ -0,0 +1,289 @@
+package wk9
+
+import (
+	stdbufio "bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// reader is the buffered reader a Conn decodes frames from. The goim
+// bufio.Reader implements it, stdReader adapts the standard library one.
+type reader interface {
+	io.Reader
+	// Pop returns the next n bytes with advancing the reader. The bytes stop
+	// being valid at the next read call.
+	Pop(n int) ([]byte, error)
+}
+
+// stdReader adapts a standard library bufio.Reader to reader.
+type stdReader struct {
+	*stdbufio.Reader
+}
+
+// Pop returns the next n bytes with advancing the reader, n must not exceed
+// the buffer size.
+func (r stdReader) Pop(n int) ([]byte, error) {
+	b, err := r.Peek(n)
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.Discard(n)
+	return b, err
+}
+
+// NewConnReader is NewConn decoding frames from br, a standard library
+// bufio.Reader over rwc, e.g. the one left by an HTTP handshake. A nil br
+// reads rwc through a new one.
+func NewConnReader(rwc io.ReadWriteCloser, br *stdbufio.Reader, client bool) *Conn {
+	if br == nil {
+		br = stdbufio.NewReader(rwc)
+	}
+	c := NewConn(rwc, client)
+	c.rdr = stdReader{br}
+	return c
+}
+
+// messageReader streams the payload of a message fragment by fragment.
+type messageReader struct {
+	c      *Conn
+	op     int
+	buf    []byte
+	fin    bool
+	err    error
+	n      int64
+	frames fragmentCount
+	utf8   *utf8Validator
+}
+
+// NextReader returns the type of the next message and a reader streaming its
+// payload, control frames are handled on the way like ReadMessage does but
+// never returned. The reader is valid until the next NextReader or
+// ReadMessage call, which first discard what is left of the message. With
+// SetValidateUTF8 on a text message fails with ErrInvalidUTF8 as soon as a
+// fragment holds an invalid sequence.
+func (c *Conn) NextReader() (op int, r io.Reader, err error) {
+	if err = c.discardReader(); err != nil {
+		return
+	}
+	mr := &messageReader{c: c}
+	var seen int64
+	if c.msgOp != 0 {
+		// resume the message ReadMessage left for a returned control frame
+		op, mr.buf, seen = c.msgOp, c.msg, int64(len(c.msg))
+		mr.frames = c.msgFrames
+		c.resetMessage()
+	} else {
+		if mr.fin, op, mr.buf, err = c.readFragment(0, 0); err != nil {
+			return
+		}
+		if op == continuationFrame {
+			return op, nil, protocolError(CloseProtocolError, fmt.Errorf("unexpected continuation frame"))
+		}
+	}
+	mr.op, mr.n = op, int64(len(mr.buf))
+	c.crossSoftLimit(seen, mr.n)
+	if op == TextFrame && c.validateUTF8 {
+		mr.utf8 = new(utf8Validator)
+		if !mr.utf8.write(mr.buf) {
+			return op, nil, c.invalidUTF8()
+		}
+	}
+	c.reader = mr
+	return op, mr, nil
+}
+
+// ctxReader is a messageReader whose reads are bound to a context.
+type ctxReader struct {
+	mr  *messageReader
+	ctx context.Context
+}
+
+// NextReaderContext is NextReader with ctx bounding the read of the first
+// frame and every Read of the returned reader, through the read deadline. A
+// cancelled read fails with the ctx error. If it cut a frame payload short
+// the Conn can't be read from anymore, every later read fails with the ctx
+// error too.
+func (c *Conn) NextReaderContext(ctx context.Context) (op int, r io.Reader, err error) {
+	stop := c.watchContext(ctx)
+	op, r, err = c.NextReader()
+	if serr := stop(); serr != nil {
+		return op, nil, serr
+	}
+	if err != nil {
+		return
+	}
+	return op, &ctxReader{mr: r.(*messageReader), ctx: ctx}, nil
+}
+
+// Read reads the payload like messageReader.Read within the context.
+func (r *ctxReader) Read(p []byte) (n int, err error) {
+	stop := r.mr.c.watchContext(r.ctx)
+	n, err = r.mr.Read(p)
+	if serr := stop(); serr != nil {
+		if r.mr.err == nil || r.mr.err == io.EOF {
+			return n, err
+		}
+		r.mr.err = serr
+		return n, serr
+	}
+	return
+}
+
+// watchContext applies the ctx deadline to reads and makes them fail right
+// away once ctx is done, until stop is called. stop restores the read
+// deadline and returns the ctx error if ctx ended.
+func (c *Conn) watchContext(ctx context.Context) (stop func() error) {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+	if t, ok := ctx.Deadline(); ok && (c.readDeadline.IsZero() || t.Before(c.readDeadline)) {
+		c.setReadDeadline(t)
+	}
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			// a deadline in the past unblocks the read in progress
+			c.setReadDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() error {
+		close(done)
+		<-exited
+		c.setReadDeadline(c.readDeadline)
+		err := ctx.Err()
+		if t, ok := ctx.Deadline(); ok && err == nil && !time.Now().Before(t) {
+			// the read deadline may fire just before ctx notices
+			err = context.DeadlineExceeded
+		}
+		if err != nil && c.rerr != nil {
+			// the deadline cut a payload short, report why
+			c.rerr = err
+		}
+		return err
+	}
+}
+
+// ReadMessageToBuffer resets buf and reads the next message into it through
+// NextReader, so the read limit and UTF-8 validation apply and control frames
+// are never returned. On error buf holds the part of the payload read.
+func (c *Conn) ReadMessageToBuffer(buf *bytes.Buffer) (op int, err error) {
+	buf.Reset()
+	var r io.Reader
+	if op, r, err = c.NextReader(); err != nil {
+		return
+	}
+	_, err = buf.ReadFrom(r)
+	return
+}
+
+// ReadMessageFunc reads the next message calling fn for each fragment as it
+// arrives with the type of the message, until fin or fn returns an error.
+// The checks of NextReader apply. The fragments are read into a buffer reused
+// from one to the next, fn must not retain one past its call. When fn fails
+// the rest of the message is discarded by the next read.
+func (c *Conn) ReadMessageFunc(fn func(op int, fragment []byte, fin bool) error) error {
+	op, r, err := c.NextReader()
+	if err != nil {
+		return err
+	}
+	mr := r.(*messageReader)
+	for {
+		if mr.fin && mr.utf8 != nil && !mr.utf8.done() {
+			return c.invalidUTF8()
+		}
+		if err = fn(op, mr.buf, mr.fin); err != nil {
+			return err
+		}
+		if mr.fin {
+			c.reader = nil
+			return nil
+		}
+		if mr.next(); mr.err != nil {
+			return mr.err
+		}
+	}
+}
+
+// Read reads the payload, io.EOF after the final fragment.
+func (r *messageReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.fin {
+			r.err = io.EOF
+			if r.utf8 != nil && !r.utf8.done() {
+				r.err = r.c.invalidUTF8()
+			}
+			continue
+		}
+		r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next reads the next fragment of the message.
+func (r *messageReader) next() {
+	c := r.c
+	fin, op, p, err := c.readFragment(r.op, r.n)
+	if err != nil {
+		r.err = incomplete(err)
+		return
+	}
+	if op != continuationFrame {
+		r.err = protocolError(CloseProtocolError, fmt.Errorf("unexpected data frame in message, op=%d", op))
+		return
+	}
+	if r.err = r.frames.add(c, len(p)); r.err != nil {
+		return
+	}
+	r.n += int64(len(p))
+	c.crossSoftLimit(r.n-int64(len(p)), r.n)
+	if r.utf8 != nil && !r.utf8.write(p) {
+		r.err = c.invalidUTF8()
+		return
+	}
+	r.buf, r.fin = p, fin
+}
+
+// readFragment reads the next data frame of a streamed message. Its payload
+// aliases the read buffer when payloads are read at once, else it is read
+// into the retained message buffer, so streaming a message allocates nothing
+// once the buffer fits its fragments. Either way the payload is only valid
+// until the next read.
+func (c *Conn) readFragment(msgOp int, n int64) (fin bool, op int, p []byte, err error) {
+	var dst []byte
+	if c.readChunk > 0 {
+		// no message is being reassembled, msgBuf is the retained buffer
+		dst = c.msgBuf()
+	}
+	if fin, op, p, err = c.readFrame(false, false, dst, msgOp, n); err == nil && dst != nil && cap(p) <= maxRetainedRead {
+		c.rbuf = p[:0]
+	}
+	return
+}
+
+// discardReader reads what is left of the message of the last NextReader.
+func (c *Conn) discardReader() error {
+	r := c.reader
+	if r == nil {
+		return nil
+	}
+	c.reader = nil
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// invalidUTF8 closes the connection with CloseInvalidFramePayloadData.
+func (c *Conn) invalidUTF8() error {
+	c.closeWrite(FormatCloseMessage(CloseInvalidFramePayloadData, ""))
+	return protocolError(CloseInvalidFramePayloadData, ErrInvalidUTF8)
+}
@@ -0,0 +1,52 @@
+package wk9
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// rttPrefix marks the pings sent by PingRTT, followed by the send time.
+var rttPrefix = []byte("rtt:")
+
+// rttStats are the round trips measured by PingRTT.
+type rttStats struct {
+	last  time.Duration
+	total time.Duration
+	count int64
+}
+
+// PingRTT sends a ping carrying its send time, the matching pong records the
+// round trip time returned by RTT. The pong handler set by SetPongHandler is
+// still called for these pongs.
+func (c *Conn) PingRTT(deadline time.Time) error {
+	b := make([]byte, len(rttPrefix)+8)
+	copy(b, rttPrefix)
+	binary.BigEndian.PutUint64(b[len(rttPrefix):], uint64(time.Now().UnixNano()))
+	return c.Ping(b, deadline)
+}
+
+// RTT returns the last and the average round trip time measured by PingRTT,
+// zero until a pong came back.
+func (c *Conn) RTT() (last, avg time.Duration) {
+	c.rttMu.Lock()
+	defer c.rttMu.Unlock()
+	if c.rtt.count == 0 {
+		return 0, 0
+	}
+	return c.rtt.last, c.rtt.total / time.Duration(c.rtt.count)
+}
+
+// recordRTT records the round trip of a pong answering PingRTT.
+func (c *Conn) recordRTT(payload []byte) {
+	if len(payload) != len(rttPrefix)+8 || !bytes.HasPrefix(payload, rttPrefix) {
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload[len(rttPrefix):])))
+	d := time.Since(sent)
+	c.rttMu.Lock()
+	c.rtt.last = d
+	c.rtt.total += d
+	c.rtt.count++
+	c.rttMu.Unlock()
+}
@@ -0,0 +1,37 @@
+package wk9
+
+import (
+	"sync/atomic"
+)
+
+// Stats holds the counters of a Conn since it was created or last Reset.
+type Stats struct {
+	// Reallocs counts the times ReadMessage, or a streamed read, had to
+	// grow the buffer a message is read into, a high count calls for a
+	// larger SetReadSizeHint.
+	Reallocs int64
+	// ReadFrames and WriteFrames count the frames read and written,
+	// indexed by opcode, e.g. ReadFrames[TextFrame]. Continuation frames
+	// are counted at index 0.
+	ReadFrames  [16]int64
+	WriteFrames [16]int64
+}
+
+// Stats returns the counters of the Conn, it's safe to call concurrently with
+// reads and writes.
+func (c *Conn) Stats() (s Stats) {
+	s.Reallocs = atomic.LoadInt64(&c.reallocs)
+	for op := range s.ReadFrames {
+		s.ReadFrames[op] = atomic.LoadInt64(&c.readFrames[op])
+		s.WriteFrames[op] = atomic.LoadInt64(&c.writeFrames[op])
+	}
+	return
+}
+
+// countFrame counts a frame of type op, an op out of the opcode range is
+// left out rather than trusted as an index.
+func countFrame(counters *[16]int64, op int) {
+	if op >= 0 && op < len(counters) {
+		atomic.AddInt64(&counters[op], 1)
+	}
+}
@@ -0,0 +1,40 @@
+package wk9
+
+import (
+	"net"
+	"time"
+)
+
+// TuneTCP sets TCP options on the underlying connection when it is a
+// *net.TCPConn, otherwise it does nothing. A positive keepAlive enables TCP
+// keepalive probes with that period, a negative one disables them and zero
+// leaves them as they are. noDelay sets TCP_NODELAY, disabling Nagle's
+// algorithm.
+func (c *Conn) TuneTCP(keepAlive time.Duration, noDelay bool) error {
+	tc, ok := c.rwc.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if keepAlive != 0 {
+		if err := tc.SetKeepAlive(keepAlive > 0); err != nil {
+			return err
+		}
+	}
+	if keepAlive > 0 {
+		if err := tc.SetKeepAlivePeriod(keepAlive); err != nil {
+			return err
+		}
+	}
+	return tc.SetNoDelay(noDelay)
+}
+
+// SetNoDelay sets TCP_NODELAY on the underlying connection, e.g. to turn
+// Nagle's algorithm back on for bulk transfers. It fails with ErrNotTCP when
+// the connection isn't a *net.TCPConn.
+func (c *Conn) SetNoDelay(noDelay bool) error {
+	tc, ok := c.rwc.(*net.TCPConn)
+	if !ok {
+		return ErrNotTCP
+	}
+	return tc.SetNoDelay(noDelay)
+}
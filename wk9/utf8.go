@@ -0,0 +1,52 @@
+package wk9
+
+import (
+	"unicode/utf8"
+)
+
+// utf8Validator checks text delivered in pieces, a rune split between two
+// pieces is carried over to the next one.
+type utf8Validator struct {
+	partial [utf8.UTFMax]byte
+	n       int
+}
+
+// write reports whether p keeps the text valid so far.
+func (v *utf8Validator) write(p []byte) bool {
+	if v.n > 0 {
+		// complete the rune left by the last piece
+		for len(p) > 0 && !utf8.FullRune(v.partial[:v.n]) {
+			v.partial[v.n] = p[0]
+			v.n++
+			p = p[1:]
+		}
+		if !utf8.FullRune(v.partial[:v.n]) {
+			return true
+		}
+		if r, size := utf8.DecodeRune(v.partial[:v.n]); r == utf8.RuneError && size == 1 {
+			return false
+		}
+		v.n = 0
+	}
+	for len(p) > 0 {
+		if p[0] < utf8.RuneSelf {
+			p = p[1:]
+			continue
+		}
+		if !utf8.FullRune(p) {
+			v.n = copy(v.partial[:], p)
+			return true
+		}
+		r, size := utf8.DecodeRune(p)
+		if r == utf8.RuneError && size == 1 {
+			return false
+		}
+		p = p[size:]
+	}
+	return true
+}
+
+// done reports whether the text doesn't end inside a rune.
+func (v *utf8Validator) done() bool {
+	return v.n == 0
+}
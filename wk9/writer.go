@@ -0,0 +1,178 @@
+package wk9
+
+import (
+	"fmt"
+	"io"
+)
+
+const writeFromChunk = 32 * 1024
+
+// MessageWriter is the writer of NextWriter.
+type MessageWriter interface {
+	io.WriteCloser
+	// Abort gives up the message without sending its final frame. If
+	// nothing was sent yet the Conn is free for other messages. Else,
+	// WebSocket having no way to cancel a message on the wire, the
+	// connection is left broken: every later write, the close frame
+	// included, fails with ErrMessageIncomplete and the connection can
+	// only be closed. Abort after Close does nothing.
+	Abort()
+}
+
+// messageWriter streams a message, each Write is sent as one fragment.
+type messageWriter struct {
+	c      *Conn
+	op     int
+	closed bool
+}
+
+// NextWriter returns a writer for the next message of type op, TextFrame or
+// BinaryFrame since control frames can't be fragmented. Each Write is sent as
+// a fragment and Close sends the final frame. Other messages can't be written
+// until the writer is closed.
+//
+// Every fragment is written whole under the write lock, which is released
+// between fragments, so a WriteControl from another goroutine, e.g. the
+// automatic pong, goes out between two fragments and never inside one. After
+// a close frame is written the remaining fragments fail with ErrConnClosing.
+func (c *Conn) NextWriter(op int) (MessageWriter, error) {
+	// control frames MUST NOT be fragmented
+	if op != TextFrame && op != BinaryFrame {
+		return nil, fmt.Errorf("not a data message, op=%d", op)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.werr != nil {
+		return nil, c.werr
+	}
+	if c.closing {
+		return nil, ErrConnClosing
+	}
+	if c.writing {
+		return nil, ErrWriterOpen
+	}
+	c.writing = true
+	return &messageWriter{c: c, op: op}, nil
+}
+
+// Write write p as a non-final fragment.
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := w.fragment(false, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close write the final frame of the message.
+func (w *messageWriter) Close() error {
+	return w.fragment(true, nil)
+}
+
+func (w *messageWriter) fragment(fin bool, p []byte) error {
+	c := w.c
+	if c.wlimit != nil {
+		if err := c.wlimit.wait(len(p), c.lastWriteDeadline()); err != nil {
+			return err
+		}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	if fin {
+		w.closed = true
+		c.writing = false
+	}
+	if c.closing {
+		return ErrConnClosing
+	}
+	if err := c.writeFragment(fin, w.op, p); err != nil {
+		return err
+	}
+	w.op = continuationFrame
+	return nil
+}
+
+// Abort gives up the message. Fragments already sent can't be taken back,
+// so if any was the connection is marked broken with ErrMessageIncomplete.
+func (w *messageWriter) Abort() {
+	c := w.c
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	c.writing = false
+	if w.op == continuationFrame && c.werr == nil {
+		c.werr = ErrMessageIncomplete
+	}
+}
+
+// ReadFrom sends what it reads from r until io.EOF as fragments of the
+// message, one per read into a buffer reused across messages. It implements
+// io.ReaderFrom so io.Copy into the writer takes this path. The message is
+// left open, Close still has to send the final frame.
+func (w *messageWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	c := w.c
+	if c.copyBuf == nil {
+		c.copyBuf = make([]byte, writeFromChunk)
+	}
+	for {
+		nr, rerr := r.Read(c.copyBuf)
+		if nr > 0 {
+			if _, err = w.Write(c.copyBuf[:nr]); err != nil {
+				return
+			}
+			n += int64(nr)
+		}
+		if rerr == io.EOF {
+			return
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// WriteFrom writes everything read from r until io.EOF as one message of
+// type op. If r fails once part of the message is sent, it is left
+// incomplete and the connection is marked broken.
+func (c *Conn) WriteFrom(op int, r io.Reader) (err error) {
+	var wc MessageWriter
+	if wc, err = c.NextWriter(op); err != nil {
+		return
+	}
+	w := wc.(*messageWriter)
+	if _, err = w.ReadFrom(r); err != nil {
+		w.Abort()
+		return
+	}
+	return w.Close()
+}
+
+// WriteFragmented writes payload as one message of type op split in frames
+// of at most size bytes, the last one carrying the FIN bit. A size of zero,
+// or one the payload fits in, writes a single frame like WriteMessage. A
+// control message can't be fragmented, it is written whole by WriteControl.
+func (c *Conn) WriteFragmented(op int, payload []byte, size int) (err error) {
+	if size <= 0 || len(payload) <= size || op >= CloseFrame {
+		return c.WriteMessage(op, payload)
+	}
+	var wc MessageWriter
+	if wc, err = c.NextWriter(op); err != nil {
+		return
+	}
+	w := wc.(*messageWriter)
+	for ; len(payload) > size; payload = payload[size:] {
+		if _, err = w.Write(payload[:size]); err != nil {
+			w.Abort()
+			return
+		}
+	}
+	return w.fragment(true, payload)
+}